@@ -0,0 +1,968 @@
+// Package processor holds the image-processor's reusable detection-scoring,
+// tracking and serving logic, so it can be driven by the scripts/image_processor
+// CLI/daemon entry point without that file growing into a second copy of
+// this logic.
+package processor
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"taskinity/dsl/internal/sink"
+)
+
+type InputData struct {
+	Timestamp  string      `json:"timestamp"`
+	Source     string      `json:"source"`
+	Data       interface{} `json:"data"`
+	Detections []Detection `json:"detections,omitempty"`
+}
+
+type Detection struct {
+	ObjectType string    `json:"object_type"`
+	Confidence float64   `json:"confidence"`
+	BBox       []float64 `json:"bbox"`
+	Position   string    `json:"position"`
+}
+
+type OutputData struct {
+	Timestamp          string              `json:"timestamp"`
+	Source             string              `json:"source"`
+	ProcessedBy        string              `json:"processed_by"`
+	EnhancedDetections []EnhancedDetection `json:"enhanced_detections"`
+	ThreatLevel        string              `json:"threat_level"`
+	ProcessingTime     float64             `json:"processing_time_ms"`
+}
+
+type EnhancedDetection struct {
+	Detection
+	RiskScore       float64 `json:"risk_score"`
+	Zone            string  `json:"zone"`
+	Action          string  `json:"recommended_action"`
+	TrackID         string  `json:"track_id,omitempty"`
+	DwellMs         int64   `json:"dwell_ms,omitempty"`
+	ZoneTransitions int     `json:"zone_transitions,omitempty"`
+}
+
+// LoadConfig reads the processor's environment-variable configuration, set
+// by Camel Router.
+func LoadConfig() map[string]string {
+	config := make(map[string]string)
+	config["zone_mapping"] = getEnv("CONFIG_ZONE_MAPPING", "entrance:high,parking:medium,garden:low")
+	config["threat_threshold"] = getEnv("CONFIG_THREAT_THRESHOLD", "0.7")
+	config["processor_name"] = getEnv("CONFIG_PROCESSOR_NAME", "golang-image-processor")
+	return config
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// --- rule engine ---
+//
+// calculateRiskScore, determineZone and recommendAction used to be hard-coded
+// switch statements. They're now expressed as data in a RuleSet, loaded from
+// CONFIG_RULES_FILE, so a Camel Router deployment can ship new weights, zone
+// polygons and action thresholds alongside the processor binary without a
+// rebuild.
+
+// ZoneRule maps detections to a named zone, either by an exact bbox-center
+// point-in-polygon test (Polygon) or, when the detection has no bbox or no
+// zone polygon contains its center, by matching Detection.Position against
+// Positions.
+type ZoneRule struct {
+	Name      string       `json:"name"`
+	Polygon   [][2]float64 `json:"polygon,omitempty"`
+	Positions []string     `json:"positions,omitempty"`
+}
+
+// ThresholdRule is one rung of the action ladder: the first rule (in file
+// order) whose Zone and ObjectTypes match the detection and whose MinScore
+// the risk score clears wins.
+type ThresholdRule struct {
+	Zone        string   `json:"zone"` // zone name, or "*" to match any zone
+	ObjectTypes []string `json:"object_types,omitempty"`
+	MinScore    float64  `json:"min_score"`
+	Action      string   `json:"action"`
+}
+
+// RuleSet is the externalized replacement for the old risk-scoring switch
+// statements.
+type RuleSet struct {
+	ObjectWeights       map[string]float64 `json:"object_weights"`
+	PositionMultipliers map[string]float64 `json:"position_multipliers"`
+	Zones               []ZoneRule         `json:"zones"`
+	DefaultZone         string             `json:"default_zone"`
+	Thresholds          []ThresholdRule    `json:"thresholds"`
+	DefaultAction       string             `json:"default_action"`
+
+	// Temporal risk boosts, applied on top of the base object/position
+	// score using the track state maintained by the Tracker.
+	DwellBoostPerSecond   float64            `json:"dwell_boost_per_second"`
+	DwellBoostMax         float64            `json:"dwell_boost_max"`
+	LoiteringDwellSeconds float64            `json:"loitering_dwell_seconds"`
+	LoiteringBoost        float64            `json:"loitering_boost"`
+	ZoneCrossingBoosts    map[string]float64 `json:"zone_crossing_boosts"` // keyed "from->to"
+}
+
+// DefaultRuleSet reproduces the original hard-coded weights, zones and
+// actions. It also sets temporal boosts, which raise the score of a track
+// that has dwelled in a zone or crossed zones over earlier frames; a
+// detection on its first frame gets no boost.
+func DefaultRuleSet() *RuleSet {
+	return &RuleSet{
+		ObjectWeights: map[string]float64{
+			"person":  1.2,
+			"car":     0.8,
+			"cat":     0.3,
+			"dog":     0.3,
+			"default": 1.0,
+		},
+		PositionMultipliers: map[string]float64{
+			"center-center": 1.1,
+		},
+		Zones: []ZoneRule{
+			{Name: "entrance", Positions: []string{"center-center"}},
+			{Name: "parking", Positions: []string{"bottom-left", "bottom-right"}},
+		},
+		DefaultZone: "perimeter",
+		Thresholds: []ThresholdRule{
+			{Zone: "*", ObjectTypes: []string{"person"}, MinScore: 0.8, Action: "alert_security"},
+			{Zone: "*", MinScore: 0.8, Action: "monitor_closely"},
+			{Zone: "*", MinScore: 0.5, Action: "log_event"},
+		},
+		DefaultAction: "ignore",
+
+		DwellBoostPerSecond:   0.01,
+		DwellBoostMax:         0.3,
+		LoiteringDwellSeconds: 60,
+		LoiteringBoost:        0.2,
+		ZoneCrossingBoosts: map[string]float64{
+			"perimeter->entrance": 0.3,
+		},
+	}
+}
+
+// LoadRuleSet reads and validates a RuleSet from a JSON file.
+func LoadRuleSet(path string) (*RuleSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules file: %w", err)
+	}
+	var rs RuleSet
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return nil, fmt.Errorf("parsing rules file: %w", err)
+	}
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+	return &rs, nil
+}
+
+// Validate catches the mistakes that would otherwise only surface as a
+// silently wrong risk score or zone in production.
+func (rs *RuleSet) Validate() error {
+	seen := map[string]bool{}
+	for _, zone := range rs.Zones {
+		if zone.Name == "" {
+			return fmt.Errorf("zone rule with empty name")
+		}
+		if seen[zone.Name] {
+			return fmt.Errorf("duplicate zone rule %q", zone.Name)
+		}
+		seen[zone.Name] = true
+		if len(zone.Polygon) > 0 && len(zone.Polygon) < 3 {
+			return fmt.Errorf("zone %q: polygon needs at least 3 points", zone.Name)
+		}
+	}
+	for i, t := range rs.Thresholds {
+		if t.Action == "" {
+			return fmt.Errorf("threshold %d: action is required", i)
+		}
+	}
+	if rs.DefaultAction == "" {
+		return fmt.Errorf("default_action is required")
+	}
+	return nil
+}
+
+func (rs *RuleSet) objectWeight(objectType string) float64 {
+	if w, ok := rs.ObjectWeights[objectType]; ok {
+		return w
+	}
+	if w, ok := rs.ObjectWeights["default"]; ok {
+		return w
+	}
+	return 1.0
+}
+
+func (rs *RuleSet) positionMultiplier(position string) float64 {
+	if m, ok := rs.PositionMultipliers[position]; ok {
+		return m
+	}
+	return 1.0
+}
+
+// zoneFor resolves a detection's zone, preferring a real bbox-center
+// point-in-polygon match over the legacy position-name fallback.
+func (rs *RuleSet) zoneFor(d Detection) string {
+	center, hasCenter := bboxCenter(d.BBox)
+	for _, zone := range rs.Zones {
+		if hasCenter && len(zone.Polygon) >= 3 && pointInPolygon(center, zone.Polygon) {
+			return zone.Name
+		}
+	}
+	for _, zone := range rs.Zones {
+		for _, pos := range zone.Positions {
+			if pos == d.Position {
+				return zone.Name
+			}
+		}
+	}
+	return rs.DefaultZone
+}
+
+func (rs *RuleSet) actionFor(riskScore float64, zone, objectType string) string {
+	for _, t := range rs.Thresholds {
+		if t.Zone != "*" && t.Zone != zone {
+			continue
+		}
+		if len(t.ObjectTypes) > 0 && !containsString(t.ObjectTypes, objectType) {
+			continue
+		}
+		if riskScore > t.MinScore {
+			return t.Action
+		}
+	}
+	return rs.DefaultAction
+}
+
+// Evaluate scores and recommends an action for a single detection, given the
+// zone it was already placed in and the dwell/zone-transition state Tracker
+// computed for its track, if any.
+func (rs *RuleSet) Evaluate(d Detection, zone string, tc TrackContext) EnhancedDetection {
+	riskScore := d.Confidence*rs.objectWeight(d.ObjectType)*rs.positionMultiplier(d.Position) + rs.temporalBoost(tc)
+	action := rs.actionFor(riskScore, zone, d.ObjectType)
+	return EnhancedDetection{
+		Detection:       d,
+		RiskScore:       riskScore,
+		Zone:            zone,
+		Action:          action,
+		TrackID:         tc.TrackID,
+		DwellMs:         tc.DwellMs,
+		ZoneTransitions: tc.ZoneTransitionCount,
+	}
+}
+
+// temporalBoost turns a track's dwell time, loitering and zone crossings
+// into an additive risk bump.
+func (rs *RuleSet) temporalBoost(tc TrackContext) float64 {
+	if tc.TrackID == "" {
+		return 0
+	}
+
+	dwellSeconds := float64(tc.DwellMs) / 1000
+	boost := dwellSeconds * rs.DwellBoostPerSecond
+	if boost > rs.DwellBoostMax {
+		boost = rs.DwellBoostMax
+	}
+
+	if rs.LoiteringDwellSeconds > 0 && dwellSeconds >= rs.LoiteringDwellSeconds {
+		boost += rs.LoiteringBoost
+	}
+
+	if tc.ZoneTransitionKey != "" {
+		boost += rs.ZoneCrossingBoosts[tc.ZoneTransitionKey]
+	}
+
+	return boost
+}
+
+func containsString(values []string, target string) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
+
+func bboxCenter(bbox []float64) ([2]float64, bool) {
+	if len(bbox) != 4 {
+		return [2]float64{}, false
+	}
+	return [2]float64{(bbox[0] + bbox[2]) / 2, (bbox[1] + bbox[3]) / 2}, true
+}
+
+// pointInPolygon is the standard ray-casting test.
+func pointInPolygon(point [2]float64, polygon [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		xi, yi := polygon[i][0], polygon[i][1]
+		xj, yj := polygon[j][0], polygon[j][1]
+		intersects := (yi > point[1]) != (yj > point[1]) &&
+			point[0] < (xj-xi)*(point[1]-yi)/(yj-yi)+xi
+		if intersects {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// currentRuleSet holds the active RuleSet. It's replaced wholesale on
+// SIGHUP so readers never see a partially-updated RuleSet.
+var currentRuleSet atomic.Value
+
+// SetRuleSet installs rs as the active RuleSet.
+func SetRuleSet(rs *RuleSet) {
+	currentRuleSet.Store(rs)
+}
+
+// ActiveRuleSet returns the active RuleSet, or DefaultRuleSet if none has
+// been installed yet.
+func ActiveRuleSet() *RuleSet {
+	if rs, ok := currentRuleSet.Load().(*RuleSet); ok {
+		return rs
+	}
+	return DefaultRuleSet()
+}
+
+// WatchRuleSetReloads reloads rulesPath on every SIGHUP, logging and keeping
+// the previous RuleSet on error instead of falling back to defaults.
+func WatchRuleSetReloads(rulesPath string) {
+	if rulesPath == "" {
+		return
+	}
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			rs, err := LoadRuleSet(rulesPath)
+			if err != nil {
+				log.Printf("rules reload failed, keeping previous rules: %v", err)
+				continue
+			}
+			SetRuleSet(rs)
+			log.Printf("reloaded rules from %s", rulesPath)
+		}
+	}()
+}
+
+// --- temporal tracking ---
+//
+// Frames used to be scored in isolation. Tracker correlates detections
+// across successive InputData frames from the same source (matched by
+// object-type and bbox IoU), assigns stable track IDs, and remembers how
+// long each track has dwelled in its current zone and when it last crossed
+// zones - state RuleSet.Evaluate folds in as a risk boost via
+// RuleSet.temporalBoost. This only does something useful across multiple
+// calls to ProcessDetections against the same Tracker, i.e. in -serve mode;
+// a one-shot CLI invocation starts with an empty Tracker and sees only one
+// frame, so every track is new and gets no boost.
+
+// TrackContext is what Tracker reports back about a single detection's
+// track for this frame.
+type TrackContext struct {
+	TrackID             string
+	DwellMs             int64
+	ZoneTransitionKey   string // "from->to", set only on the frame the crossing happens
+	ZoneTransitionCount int
+}
+
+// Track is the per-object state Tracker maintains between frames.
+type Track struct {
+	ID              string
+	Source          string
+	ObjectType      string
+	BBox            []float64
+	FirstSeen       time.Time
+	LastSeen        time.Time
+	Trajectory      [][2]float64 // bounded history of bbox-center points
+	Zone            string
+	ZoneEnteredAt   time.Time
+	TransitionCount int
+
+	elem *list.Element // back-pointer into Tracker.lru
+}
+
+const maxTrajectoryPoints = 50
+
+// Tracker is a bounded, greedy IoU-based multi-object tracker. It is safe
+// for concurrent use, since -serve mode may process frames from several
+// sources concurrently across the worker pool.
+type Tracker struct {
+	mu           sync.Mutex
+	tracks       map[string]*Track
+	lru          *list.List // front = most recently touched
+	maxTracks    int
+	maxAge       time.Duration
+	iouThreshold float64
+	nextID       uint64
+}
+
+func NewTracker(maxTracks int, maxAge time.Duration, iouThreshold float64) *Tracker {
+	return &Tracker{
+		tracks:       make(map[string]*Track),
+		lru:          list.New(),
+		maxTracks:    maxTracks,
+		maxAge:       maxAge,
+		iouThreshold: iouThreshold,
+	}
+}
+
+// ObserveFrame matches detections against existing tracks for source,
+// updates track state, and returns one TrackContext per detection, in the
+// same order as detections. Detections without a usable bbox are assigned a
+// fresh track each frame, since there's nothing to match against.
+func (t *Tracker) ObserveFrame(source string, detections []Detection, zones []string, now time.Time) []TrackContext {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.evictStale(now)
+
+	candidates := t.candidateTracks(source)
+	matches := t.greedyMatch(candidates, detections)
+
+	results := make([]TrackContext, len(detections))
+
+	for i, detection := range detections {
+		zone := ""
+		if i < len(zones) {
+			zone = zones[i]
+		}
+
+		track, matched := matches[i]
+		if !matched {
+			track = t.newTrack(source, detection, zone, now)
+		}
+		results[i] = t.updateTrack(track, detection, zone, now)
+	}
+
+	t.enforceCapacity()
+	return results
+}
+
+func (t *Tracker) candidateTracks(source string) []*Track {
+	var candidates []*Track
+	for _, track := range t.tracks {
+		if track.Source == source {
+			candidates = append(candidates, track)
+		}
+	}
+	return candidates
+}
+
+type trackMatch struct {
+	detectionIdx int
+	track        *Track
+	iou          float64
+}
+
+// greedyMatch pairs detections with existing tracks of the same object type
+// whose IoU clears iouThreshold, preferring the best-overlapping pair first.
+// This is the greedy fallback; an optimal (Hungarian) assignment isn't
+// implemented here since greedy is the explicitly allowed fallback and
+// avoids pulling in an assignment-problem solver for a handful of tracks.
+func (t *Tracker) greedyMatch(candidates []*Track, detections []Detection) map[int]*Track {
+	var possible []trackMatch
+	for di, d := range detections {
+		for _, track := range candidates {
+			if track.ObjectType != d.ObjectType {
+				continue
+			}
+			score := iou(track.BBox, d.BBox)
+			if score > t.iouThreshold {
+				possible = append(possible, trackMatch{detectionIdx: di, track: track, iou: score})
+			}
+		}
+	}
+	sort.Slice(possible, func(i, j int) bool { return possible[i].iou > possible[j].iou })
+
+	matches := make(map[int]*Track)
+	usedTracks := make(map[string]bool)
+	for _, m := range possible {
+		if _, taken := matches[m.detectionIdx]; taken {
+			continue
+		}
+		if usedTracks[m.track.ID] {
+			continue
+		}
+		matches[m.detectionIdx] = m.track
+		usedTracks[m.track.ID] = true
+	}
+	return matches
+}
+
+func (t *Tracker) newTrack(source string, d Detection, zone string, now time.Time) *Track {
+	t.nextID++
+	track := &Track{
+		ID:            fmt.Sprintf("trk-%d", t.nextID),
+		Source:        source,
+		ObjectType:    d.ObjectType,
+		FirstSeen:     now,
+		Zone:          zone,
+		ZoneEnteredAt: now,
+	}
+	t.tracks[track.ID] = track
+	track.elem = t.lru.PushFront(track.ID)
+	return track
+}
+
+func (t *Tracker) updateTrack(track *Track, d Detection, zone string, now time.Time) TrackContext {
+	track.BBox = d.BBox
+	track.LastSeen = now
+	if center, ok := bboxCenter(d.BBox); ok {
+		track.Trajectory = append(track.Trajectory, center)
+		if len(track.Trajectory) > maxTrajectoryPoints {
+			track.Trajectory = track.Trajectory[len(track.Trajectory)-maxTrajectoryPoints:]
+		}
+	}
+	t.lru.MoveToFront(track.elem)
+
+	var transitionKey string
+	if zone != "" && zone != track.Zone {
+		transitionKey = fmt.Sprintf("%s->%s", track.Zone, zone)
+		track.Zone = zone
+		track.ZoneEnteredAt = now
+		track.TransitionCount++
+	}
+
+	return TrackContext{
+		TrackID:             track.ID,
+		DwellMs:             now.Sub(track.ZoneEnteredAt).Milliseconds(),
+		ZoneTransitionKey:   transitionKey,
+		ZoneTransitionCount: track.TransitionCount,
+	}
+}
+
+// evictStale drops tracks that haven't been seen within maxAge. Must be
+// called with mu held.
+func (t *Tracker) evictStale(now time.Time) {
+	if t.maxAge <= 0 {
+		return
+	}
+	for id, track := range t.tracks {
+		if now.Sub(track.LastSeen) > t.maxAge && !track.LastSeen.IsZero() {
+			t.removeTrack(id)
+		}
+	}
+}
+
+// enforceCapacity evicts the least-recently-touched tracks once the tracker
+// holds more than maxTracks, bounding memory even under a flood of
+// never-revisited objects. Must be called with mu held.
+func (t *Tracker) enforceCapacity() {
+	if t.maxTracks <= 0 {
+		return
+	}
+	for len(t.tracks) > t.maxTracks {
+		back := t.lru.Back()
+		if back == nil {
+			return
+		}
+		t.removeTrack(back.Value.(string))
+	}
+}
+
+func (t *Tracker) removeTrack(id string) {
+	track, ok := t.tracks[id]
+	if !ok {
+		return
+	}
+	t.lru.Remove(track.elem)
+	delete(t.tracks, id)
+}
+
+// iou is the intersection-over-union of two [x1,y1,x2,y2] boxes.
+func iou(a, b []float64) float64 {
+	if len(a) != 4 || len(b) != 4 {
+		return 0
+	}
+	x1, y1 := math.Max(a[0], b[0]), math.Max(a[1], b[1])
+	x2, y2 := math.Min(a[2], b[2]), math.Min(a[3], b[3])
+	if x2 <= x1 || y2 <= y1 {
+		return 0
+	}
+	intersection := (x2 - x1) * (y2 - y1)
+	areaA := (a[2] - a[0]) * (a[3] - a[1])
+	areaB := (b[2] - b[0]) * (b[3] - b[1])
+	union := areaA + areaB - intersection
+	if union <= 0 {
+		return 0
+	}
+	return intersection / union
+}
+
+// currentTracker holds the process-wide tracker state. It's set up once in
+// main, before either the -serve or one-shot code paths run.
+var currentTracker *Tracker
+
+// SetTracker installs t as the active Tracker.
+func SetTracker(t *Tracker) {
+	currentTracker = t
+}
+
+// ActiveTracker returns the active Tracker, creating a default-sized one on
+// first use if main never called SetTracker.
+func ActiveTracker() *Tracker {
+	if currentTracker == nil {
+		currentTracker = NewTracker(1000, 5*time.Minute, 0.3)
+	}
+	return currentTracker
+}
+
+func ProcessDetections(input InputData, config map[string]string) OutputData {
+	startTime := time.Now()
+	rs := ActiveRuleSet()
+
+	zones := make([]string, len(input.Detections))
+	for i, detection := range input.Detections {
+		zones[i] = rs.zoneFor(detection)
+	}
+	trackContexts := ActiveTracker().ObserveFrame(input.Source, input.Detections, zones, startTime)
+
+	var enhanced []EnhancedDetection
+	maxRisk := 0.0
+
+	for i, detection := range input.Detections {
+		result := rs.Evaluate(detection, zones[i], trackContexts[i])
+		enhanced = append(enhanced, result)
+
+		if result.RiskScore > maxRisk {
+			maxRisk = result.RiskScore
+		}
+	}
+
+	// Determine overall threat level
+	threatLevel := "low"
+	if maxRisk > 0.8 {
+		threatLevel = "high"
+	} else if maxRisk > 0.5 {
+		threatLevel = "medium"
+	}
+
+	processingTime := float64(time.Since(startTime).Nanoseconds()) / 1e6 // Convert to milliseconds
+
+	return OutputData{
+		Timestamp:          time.Now().Format(time.RFC3339),
+		Source:             input.Source,
+		ProcessedBy:        config["processor_name"],
+		EnhancedDetections: enhanced,
+		ThreatLevel:        threatLevel,
+		ProcessingTime:     processingTime,
+	}
+}
+
+// --- serve mode ---
+//
+// -serve turns the one-shot CLI into a persistent worker that Camel Router
+// (or anything else speaking HTTP) can POST InputData batches to, instead of
+// forking a process per frame.
+
+type processingJob struct {
+	input    InputData
+	config   map[string]string
+	resultCh chan processingResult
+}
+
+type processingResult struct {
+	output OutputData
+	err    error
+}
+
+// WorkerPool bounds concurrent processing to poolSize goroutines. jobs is
+// sized to provide a fixed amount of backpressure: once it's full, submitJob
+// blocks (bounded by the caller's deadlineTimer) rather than growing without
+// limit.
+type WorkerPool struct {
+	jobs chan processingJob
+}
+
+func NewWorkerPool(poolSize, queueSize int) *WorkerPool {
+	pool := &WorkerPool{jobs: make(chan processingJob, queueSize)}
+	for i := 0; i < poolSize; i++ {
+		go pool.worker()
+	}
+	return pool
+}
+
+func (p *WorkerPool) worker() {
+	for job := range p.jobs {
+		job.resultCh <- processingResult{output: ProcessDetections(job.input, job.config)}
+	}
+}
+
+// submitJob enqueues a job, applying backpressure by blocking until the
+// queue has room, a worker frees up, or the deadline fires first.
+func (p *WorkerPool) submitJob(job processingJob, dt *deadlineTimer) error {
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-dt.cancel:
+		return fmt.Errorf("deadline exceeded waiting for a free worker")
+	}
+}
+
+// deadlineTimer is the cancel-channel pattern used to bound how long a
+// request may wait for a worker or a result: cancel is closed once timeout
+// elapses, so callers can select on it alongside the channels they're
+// actually waiting on. The watcher goroutine also selects on stopCh so that
+// stop() on the (overwhelmingly common) non-expired path makes it return
+// immediately instead of leaking until the timer eventually fires.
+type deadlineTimer struct {
+	timer  *time.Timer
+	cancel chan struct{}
+	stopCh chan struct{}
+}
+
+func newDeadlineTimer(timeout time.Duration) *deadlineTimer {
+	dt := &deadlineTimer{
+		timer:  time.NewTimer(timeout),
+		cancel: make(chan struct{}),
+		stopCh: make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-dt.timer.C:
+			close(dt.cancel)
+		case <-dt.stopCh:
+		}
+	}()
+	return dt
+}
+
+func (dt *deadlineTimer) stop() {
+	dt.timer.Stop()
+	close(dt.stopCh)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: message, Code: code})
+}
+
+// ServerMetrics tracks the counters exposed at /metrics.
+type ServerMetrics struct {
+	processedFrames int64
+
+	mu                sync.Mutex
+	threatLevelCounts map[string]int64
+	latencySumMs      float64
+	latencyCount      int64
+}
+
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{threatLevelCounts: make(map[string]int64)}
+}
+
+func (m *ServerMetrics) record(output OutputData) {
+	atomic.AddInt64(&m.processedFrames, 1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.threatLevelCounts[output.ThreatLevel]++
+	m.latencySumMs += output.ProcessingTime
+	m.latencyCount++
+}
+
+// currentOutputSink is nil unless CONFIG_SINK_URL is set.
+var currentOutputSink *sink.OutputSink
+
+// SetOutputSink installs s as the sink every published OutputData is sent
+// to. Passing nil disables publishing.
+func SetOutputSink(s *sink.OutputSink) {
+	currentOutputSink = s
+}
+
+// RecordAndPublish updates the request metrics and, if SetOutputSink
+// configured an output sink, enqueues the result for publishing.
+func RecordAndPublish(m *ServerMetrics, output OutputData) {
+	m.record(output)
+	PublishOutput(output)
+}
+
+// PublishOutput enqueues output for publishing on the sink configured via
+// SetOutputSink, if any, without touching ServerMetrics. It's what the
+// one-shot (non -serve) code path uses, matching the original CLI's
+// behaviour of not accumulating server metrics for a single invocation.
+func PublishOutput(output OutputData) {
+	if currentOutputSink == nil {
+		return
+	}
+	if payload, err := json.Marshal(output); err != nil {
+		log.Printf("Error marshaling output for sink publish: %v", err)
+	} else {
+		currentOutputSink.Publish(payload)
+	}
+}
+
+func (m *ServerMetrics) writePrometheus(w http.ResponseWriter) {
+	fmt.Fprintln(w, "# HELP image_processor_frames_processed_total Number of frames processed since startup.")
+	fmt.Fprintln(w, "# TYPE image_processor_frames_processed_total counter")
+	fmt.Fprintf(w, "image_processor_frames_processed_total %d\n", atomic.LoadInt64(&m.processedFrames))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP image_processor_threat_level_total Frames processed per threat level.")
+	fmt.Fprintln(w, "# TYPE image_processor_threat_level_total counter")
+	for level, count := range m.threatLevelCounts {
+		fmt.Fprintf(w, "image_processor_threat_level_total{level=%q} %d\n", level, count)
+	}
+
+	fmt.Fprintln(w, "# HELP image_processor_processing_time_ms_sum Sum of per-frame processing time, in milliseconds.")
+	fmt.Fprintln(w, "# TYPE image_processor_processing_time_ms_sum counter")
+	fmt.Fprintf(w, "image_processor_processing_time_ms_sum %g\n", m.latencySumMs)
+	fmt.Fprintln(w, "# HELP image_processor_processing_time_ms_count Number of frames contributing to the latency sum.")
+	fmt.Fprintln(w, "# TYPE image_processor_processing_time_ms_count counter")
+	fmt.Fprintf(w, "image_processor_processing_time_ms_count %d\n", m.latencyCount)
+}
+
+// processOne submits a single InputData to the pool and waits for a result,
+// bounded by requestTimeout.
+func processOne(pool *WorkerPool, config map[string]string, input InputData, requestTimeout time.Duration) (OutputData, error) {
+	dt := newDeadlineTimer(requestTimeout)
+	defer dt.stop()
+
+	job := processingJob{input: input, config: config, resultCh: make(chan processingResult, 1)}
+	if err := pool.submitJob(job, dt); err != nil {
+		return OutputData{}, err
+	}
+
+	select {
+	case result := <-job.resultCh:
+		return result.output, result.err
+	case <-dt.cancel:
+		return OutputData{}, fmt.Errorf("deadline exceeded waiting for processing result")
+	}
+}
+
+// ServeHTTP runs the persistent HTTP worker: /process, /process/batch,
+// /process/stream and /metrics.
+func ServeHTTP(addr string, pool *WorkerPool, config map[string]string, metrics *ServerMetrics, requestTimeout time.Duration, streamMaxLineBytes int) error {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/process", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "expected POST")
+			return
+		}
+		var input InputData
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json", err.Error())
+			return
+		}
+
+		output, err := processOne(pool, config, input, requestTimeout)
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, "processing_failed", err.Error())
+			return
+		}
+		RecordAndPublish(metrics, output)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(output)
+	})
+
+	mux.HandleFunc("/process/batch", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "expected POST")
+			return
+		}
+		var inputs []InputData
+		if err := json.NewDecoder(r.Body).Decode(&inputs); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_json", err.Error())
+			return
+		}
+
+		outputs := make([]OutputData, len(inputs))
+		for i, input := range inputs {
+			output, err := processOne(pool, config, input, requestTimeout)
+			if err != nil {
+				writeError(w, http.StatusServiceUnavailable, "processing_failed", err.Error())
+				return
+			}
+			RecordAndPublish(metrics, output)
+			outputs[i] = output
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(outputs)
+	})
+
+	// /process/stream accepts newline-delimited InputData and replies with
+	// newline-delimited OutputData as each frame finishes, so a client can
+	// keep one connection open and push frames as they arrive rather than
+	// opening a request per frame.
+	mux.HandleFunc("/process/stream", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "expected POST")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "streaming_unsupported", "response writer does not support flushing")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), streamMaxLineBytes)
+		encoder := json.NewEncoder(w)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			var input InputData
+			if err := json.Unmarshal(line, &input); err != nil {
+				encoder.Encode(errorResponse{Error: err.Error(), Code: "invalid_json"})
+				flusher.Flush()
+				continue
+			}
+			output, err := processOne(pool, config, input, requestTimeout)
+			if err != nil {
+				encoder.Encode(errorResponse{Error: err.Error(), Code: "processing_failed"})
+				flusher.Flush()
+				continue
+			}
+			RecordAndPublish(metrics, output)
+			encoder.Encode(output)
+			flusher.Flush()
+		}
+		if err := scanner.Err(); err != nil {
+			encoder.Encode(errorResponse{Error: err.Error(), Code: "stream_read_failed"})
+			flusher.Flush()
+		}
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writePrometheus(w)
+	})
+
+	log.Printf("image-processor serving on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
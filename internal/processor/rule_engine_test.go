@@ -0,0 +1,158 @@
+package processor
+
+import "testing"
+
+func TestPointInPolygon(t *testing.T) {
+	square := [][2]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	tests := []struct {
+		name  string
+		point [2]float64
+		want  bool
+	}{
+		{"inside", [2]float64{5, 5}, true},
+		{"outside", [2]float64{20, 20}, false},
+		{"outside left", [2]float64{-1, 5}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pointInPolygon(tt.point, square); got != tt.want {
+				t.Errorf("pointInPolygon(%v) = %v, want %v", tt.point, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBBoxCenter(t *testing.T) {
+	tests := []struct {
+		name       string
+		bbox       []float64
+		wantCenter [2]float64
+		wantOK     bool
+	}{
+		{"valid box", []float64{0, 0, 10, 20}, [2]float64{5, 10}, true},
+		{"wrong length", []float64{0, 0, 10}, [2]float64{}, false},
+		{"empty", nil, [2]float64{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			center, ok := bboxCenter(tt.bbox)
+			if ok != tt.wantOK || center != tt.wantCenter {
+				t.Errorf("bboxCenter(%v) = (%v, %v), want (%v, %v)", tt.bbox, center, ok, tt.wantCenter, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRuleSetZoneFor(t *testing.T) {
+	rs := &RuleSet{
+		Zones: []ZoneRule{
+			{Name: "entrance", Polygon: [][2]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}}},
+			{Name: "parking", Positions: []string{"bottom-left"}},
+		},
+		DefaultZone: "perimeter",
+	}
+
+	tests := []struct {
+		name string
+		d    Detection
+		want string
+	}{
+		{"polygon match wins", Detection{BBox: []float64{2, 2, 4, 4}, Position: "bottom-left"}, "entrance"},
+		{"falls back to position", Detection{Position: "bottom-left"}, "parking"},
+		{"falls back to default", Detection{Position: "top-right"}, "perimeter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rs.zoneFor(tt.d); got != tt.want {
+				t.Errorf("zoneFor(%+v) = %q, want %q", tt.d, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleSetActionFor(t *testing.T) {
+	rs := &RuleSet{
+		Thresholds: []ThresholdRule{
+			{Zone: "entrance", ObjectTypes: []string{"person"}, MinScore: 0.8, Action: "alert_security"},
+			{Zone: "*", MinScore: 0.5, Action: "log_event"},
+		},
+		DefaultAction: "ignore",
+	}
+
+	tests := []struct {
+		name       string
+		riskScore  float64
+		zone       string
+		objectType string
+		want       string
+	}{
+		{"zone+type specific rule wins", 0.9, "entrance", "person", "alert_security"},
+		{"specific rule skipped for wrong type", 0.9, "entrance", "car", "log_event"},
+		{"falls through to wildcard", 0.6, "parking", "car", "log_event"},
+		{"falls through to default", 0.1, "parking", "car", "ignore"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rs.actionFor(tt.riskScore, tt.zone, tt.objectType); got != tt.want {
+				t.Errorf("actionFor(%v, %q, %q) = %q, want %q", tt.riskScore, tt.zone, tt.objectType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleSetValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rs      RuleSet
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rs: RuleSet{
+				Zones:         []ZoneRule{{Name: "entrance"}},
+				Thresholds:    []ThresholdRule{{Action: "alert_security"}},
+				DefaultAction: "ignore",
+			},
+			wantErr: false,
+		},
+		{
+			name:    "empty zone name",
+			rs:      RuleSet{Zones: []ZoneRule{{Name: ""}}, DefaultAction: "ignore"},
+			wantErr: true,
+		},
+		{
+			name: "duplicate zone name",
+			rs: RuleSet{
+				Zones:         []ZoneRule{{Name: "entrance"}, {Name: "entrance"}},
+				DefaultAction: "ignore",
+			},
+			wantErr: true,
+		},
+		{
+			name: "polygon too small",
+			rs: RuleSet{
+				Zones:         []ZoneRule{{Name: "entrance", Polygon: [][2]float64{{0, 0}, {1, 1}}}},
+				DefaultAction: "ignore",
+			},
+			wantErr: true,
+		},
+		{
+			name:    "threshold missing action",
+			rs:      RuleSet{Thresholds: []ThresholdRule{{MinScore: 0.5}}, DefaultAction: "ignore"},
+			wantErr: true,
+		},
+		{
+			name:    "missing default action",
+			rs:      RuleSet{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rs.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package processor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIoU(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		{"identical boxes", []float64{0, 0, 10, 10}, []float64{0, 0, 10, 10}, 1.0},
+		{"no overlap", []float64{0, 0, 10, 10}, []float64{20, 20, 30, 30}, 0.0},
+		{"half overlap", []float64{0, 0, 10, 10}, []float64{5, 0, 15, 10}, 1.0 / 3},
+		{"wrong length", []float64{0, 0, 10}, []float64{0, 0, 10, 10}, 0.0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := iou(tt.a, tt.b); got != tt.want {
+				t.Errorf("iou(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackerObserveFrameMatchesByIoU(t *testing.T) {
+	tr := NewTracker(10, time.Minute, 0.3)
+	now := time.Now()
+
+	first := tr.ObserveFrame("cam1", []Detection{
+		{ObjectType: "person", BBox: []float64{0, 0, 10, 10}},
+	}, []string{"entrance"}, now)
+	if len(first) != 1 || first[0].TrackID == "" {
+		t.Fatalf("expected a new track to be assigned, got %+v", first)
+	}
+	trackID := first[0].TrackID
+
+	// A detection overlapping the same bbox a moment later should match the
+	// existing track rather than creating a new one.
+	second := tr.ObserveFrame("cam1", []Detection{
+		{ObjectType: "person", BBox: []float64{1, 1, 11, 11}},
+	}, []string{"entrance"}, now.Add(time.Second))
+	if second[0].TrackID != trackID {
+		t.Errorf("expected overlapping detection to match existing track %q, got %q", trackID, second[0].TrackID)
+	}
+	if second[0].DwellMs <= 0 {
+		t.Errorf("expected dwell time to accumulate, got %dms", second[0].DwellMs)
+	}
+}
+
+func TestTrackerObserveFrameNewTrackOnNoOverlap(t *testing.T) {
+	tr := NewTracker(10, time.Minute, 0.3)
+	now := time.Now()
+
+	tr.ObserveFrame("cam1", []Detection{
+		{ObjectType: "person", BBox: []float64{0, 0, 10, 10}},
+	}, []string{"entrance"}, now)
+
+	elsewhere := tr.ObserveFrame("cam1", []Detection{
+		{ObjectType: "person", BBox: []float64{100, 100, 110, 110}},
+	}, []string{"parking"}, now.Add(time.Second))
+
+	if len(tr.tracks) != 2 {
+		t.Errorf("expected a second, independent track for the non-overlapping detection, got %d tracks", len(tr.tracks))
+	}
+	if elsewhere[0].ZoneTransitionCount != 0 {
+		t.Errorf("a brand-new track should not report a zone transition, got count %d", elsewhere[0].ZoneTransitionCount)
+	}
+}
+
+func TestTrackerZoneTransition(t *testing.T) {
+	tr := NewTracker(10, time.Minute, 0.3)
+	now := time.Now()
+
+	tr.ObserveFrame("cam1", []Detection{
+		{ObjectType: "person", BBox: []float64{0, 0, 10, 10}},
+	}, []string{"perimeter"}, now)
+
+	moved := tr.ObserveFrame("cam1", []Detection{
+		{ObjectType: "person", BBox: []float64{1, 1, 11, 11}},
+	}, []string{"entrance"}, now.Add(time.Second))
+
+	if moved[0].ZoneTransitionKey != "perimeter->entrance" {
+		t.Errorf("ZoneTransitionKey = %q, want %q", moved[0].ZoneTransitionKey, "perimeter->entrance")
+	}
+	if moved[0].ZoneTransitionCount != 1 {
+		t.Errorf("ZoneTransitionCount = %d, want 1", moved[0].ZoneTransitionCount)
+	}
+}
+
+func TestTrackerEvictStale(t *testing.T) {
+	tr := NewTracker(10, time.Minute, 0.3)
+	now := time.Now()
+
+	tr.ObserveFrame("cam1", []Detection{
+		{ObjectType: "person", BBox: []float64{0, 0, 10, 10}},
+	}, []string{"entrance"}, now)
+	if len(tr.tracks) != 1 {
+		t.Fatalf("expected 1 track before eviction, got %d", len(tr.tracks))
+	}
+
+	tr.mu.Lock()
+	tr.evictStale(now.Add(2 * time.Minute))
+	tr.mu.Unlock()
+
+	if len(tr.tracks) != 0 {
+		t.Errorf("expected the track older than maxAge to be evicted, got %d tracks", len(tr.tracks))
+	}
+}
+
+func TestTrackerEnforceCapacity(t *testing.T) {
+	tr := NewTracker(2, time.Minute, 0.3)
+	now := time.Now()
+
+	for i := 0; i < 5; i++ {
+		tr.ObserveFrame("cam1", []Detection{
+			{ObjectType: "person", BBox: []float64{float64(i * 100), 0, float64(i*100 + 10), 10}},
+		}, []string{"entrance"}, now)
+	}
+
+	if len(tr.tracks) != 2 {
+		t.Errorf("expected capacity to be enforced at 2 tracks, got %d", len(tr.tracks))
+	}
+}
+
+func TestRuleSetTemporalBoost(t *testing.T) {
+	rs := &RuleSet{
+		DwellBoostPerSecond:   0.01,
+		DwellBoostMax:         0.3,
+		LoiteringDwellSeconds: 60,
+		LoiteringBoost:        0.2,
+		ZoneCrossingBoosts:    map[string]float64{"perimeter->entrance": 0.3},
+	}
+
+	tests := []struct {
+		name string
+		tc   TrackContext
+		want float64
+	}{
+		{"no track yields no boost", TrackContext{}, 0},
+		{"dwell boost under max", TrackContext{TrackID: "trk-1", DwellMs: 10_000}, 0.1},
+		{"dwell boost capped at max", TrackContext{TrackID: "trk-1", DwellMs: 60_000}, 0.3 + 0.2},
+		{"zone crossing adds its own boost", TrackContext{TrackID: "trk-1", ZoneTransitionKey: "perimeter->entrance"}, 0.3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rs.temporalBoost(tt.tc); got != tt.want {
+				t.Errorf("temporalBoost(%+v) = %v, want %v", tt.tc, got, tt.want)
+			}
+		})
+	}
+}
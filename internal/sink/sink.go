@@ -0,0 +1,509 @@
+// Package sink publishes newline-batched payloads to one or more message
+// brokers with an at-least-once disk spool, so an image-processor or
+// health-check daemon doesn't drop results during a broker outage.
+//
+// CONFIG_SINK_URL is a comma-separated list of URLs, one per sink, e.g.
+// "mqtt://broker:1883/topic/detections,nats://broker:4222/detections".
+// Only mqtt:// and nats:// are implemented against the raw wire protocol
+// here; kafka:// and amqp:// need a real client library
+// (segmentio/kafka-go, rabbitmq/amqp091-go) that this dependency-free tree
+// doesn't vendor, so they're rejected at configuration time instead of
+// being accepted and then failing (and spooling) every publish forever.
+// Delivery is confirmed by the broker only for mqtt:// (QoS 1 PUBACK); a
+// nats:// publish counts as delivered once it is written to the connection.
+package sink
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rawSink is a single broker connection. publish must be safe to call after
+// a previous failure - implementations should attempt to reconnect.
+type rawSink interface {
+	publish(payload []byte) error
+	close() error
+}
+
+// sanitizeSpoolName turns a sink URL into a filesystem-safe spool filename
+// fragment. It's only a readability aid; uniqueness is guaranteed by the
+// caller prefixing it with the sink's index.
+func sanitizeSpoolName(sinkURL string) string {
+	name := strings.NewReplacer("/", "_", ":", "_", "?", "_", "&", "_").Replace(sinkURL)
+	if name == "" {
+		return "sink"
+	}
+	return name
+}
+
+func newRawSink(sinkURL string) (rawSink, string, error) {
+	parsed, err := url.Parse(sinkURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing sink url %q: %w", sinkURL, err)
+	}
+	topic := strings.TrimPrefix(parsed.Path, "/")
+
+	switch parsed.Scheme {
+	case "mqtt":
+		return &mqttRawSink{addr: parsed.Host, topic: topic}, topic, nil
+	case "nats":
+		return &natsRawSink{addr: parsed.Host, subject: topic}, topic, nil
+	case "kafka":
+		return nil, "", fmt.Errorf("kafka:// sink requires github.com/segmentio/kafka-go, which is not vendored in this build")
+	case "amqp":
+		return nil, "", fmt.Errorf("amqp:// sink requires github.com/rabbitmq/amqp091-go, which is not vendored in this build")
+	default:
+		return nil, "", fmt.Errorf("unsupported sink scheme %q", parsed.Scheme)
+	}
+}
+
+// mqttRawSink hand-rolls the minimal MQTT 3.1.1 CONNECT + PUBLISH (QoS 1)
+// packets needed to publish a message with a delivery acknowledgement, to
+// avoid depending on an MQTT client library. QoS 1 (rather than QoS 0) is
+// what the spooledSink wrapper needs to actually provide at-least-once
+// delivery: a successful conn.Write only proves the bytes reached the
+// local TCP stack, not that the broker accepted them, so publish blocks for
+// the matching PUBACK before reporting success.
+type mqttRawSink struct {
+	addr  string
+	topic string
+
+	mu        sync.Mutex
+	conn      net.Conn
+	nextPktID uint16
+}
+
+const mqttAckTimeout = 5 * time.Second
+
+func (s *mqttRawSink) ensureConnected() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if err := mqttWriteConnect(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := mqttReadConnack(conn, mqttAckTimeout); err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// packetID returns the next QoS 1 packet identifier, a non-zero uint16 as
+// required by the MQTT spec, wrapping back to 1 instead of 0.
+func (s *mqttRawSink) packetID() uint16 {
+	s.nextPktID++
+	if s.nextPktID == 0 {
+		s.nextPktID = 1
+	}
+	return s.nextPktID
+}
+
+func (s *mqttRawSink) publish(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ensureConnected(); err != nil {
+		return err
+	}
+	pktID := s.packetID()
+	if err := mqttWritePublish(s.conn, s.topic, payload, pktID); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	if err := mqttReadPuback(s.conn, mqttAckTimeout, pktID); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *mqttRawSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func mqttRemainingLength(n int) []byte {
+	var out []byte
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return out
+}
+
+func mqttWriteConnect(conn net.Conn) error {
+	clientID := fmt.Sprintf("image-processor-%d", time.Now().UnixNano())
+	var payload []byte
+	payload = append(payload, 0x00, 0x04, 'M', 'Q', 'T', 'T') // protocol name
+	payload = append(payload, 0x04)                           // protocol level (3.1.1)
+	payload = append(payload, 0x02)                           // connect flags: clean session
+	// Keep-alive 0 (disabled): this client never sends PINGREQ, so
+	// advertising a nonzero interval would just get the connection dropped
+	// as idle between publishes and force a silent reconnect.
+	payload = append(payload, 0x00, 0x00)
+	payload = append(payload, byte(len(clientID)>>8), byte(len(clientID)))
+	payload = append(payload, clientID...)
+
+	packet := append([]byte{0x10}, mqttRemainingLength(len(payload))...)
+	packet = append(packet, payload...)
+	_, err := conn.Write(packet)
+	return err
+}
+
+// mqttWritePublish writes a QoS 1 PUBLISH carrying pktID, the packet
+// identifier the broker must echo back in its PUBACK.
+func mqttWritePublish(conn net.Conn, topic string, payload []byte, pktID uint16) error {
+	var body []byte
+	body = append(body, byte(len(topic)>>8), byte(len(topic)))
+	body = append(body, topic...)
+	body = append(body, byte(pktID>>8), byte(pktID))
+	body = append(body, payload...)
+
+	packet := append([]byte{0x32}, mqttRemainingLength(len(body))...) // PUBLISH, QoS 1
+	packet = append(packet, body...)
+	_, err := conn.Write(packet)
+	return err
+}
+
+// mqttReadRemainingLength reads an MQTT variable-length remaining-length
+// field from conn.
+func mqttReadRemainingLength(conn net.Conn) (int, error) {
+	multiplier := 1
+	value := 0
+	for {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return 0, err
+		}
+		value += int(b[0]&0x7F) * multiplier
+		if b[0]&0x80 == 0 {
+			return value, nil
+		}
+		multiplier *= 128
+	}
+}
+
+// mqttReadPacket blocks (bounded by timeout) for the next packet on conn and
+// returns its body if its type is wantType, or an error if the next packet
+// has any other type. It reads the shared shape of
+// CONNACK and PUBACK: a one-byte header, a variable-length remaining-length,
+// then a fixed-layout body.
+func mqttReadPacket(conn net.Conn, timeout time.Duration, wantType byte, name string) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("reading %s header: %w", name, err)
+	}
+	if header[0]&0xF0 != wantType {
+		return nil, fmt.Errorf("expected %s, got packet type 0x%X", name, header[0]&0xF0)
+	}
+	remaining, err := mqttReadRemainingLength(conn)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s remaining length: %w", name, err)
+	}
+	body := make([]byte, remaining)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, fmt.Errorf("reading %s body: %w", name, err)
+	}
+	return body, nil
+}
+
+// mqttReadConnack blocks (bounded by timeout) for the broker's CONNACK and
+// fails if it reports anything other than success.
+func mqttReadConnack(conn net.Conn, timeout time.Duration) error {
+	body, err := mqttReadPacket(conn, timeout, 0x20, "CONNACK")
+	if err != nil {
+		return err
+	}
+	if len(body) < 2 || body[1] != 0x00 {
+		return fmt.Errorf("CONNACK reported failure (return code %v)", body)
+	}
+	return nil
+}
+
+// mqttReadPuback blocks (bounded by timeout) for the PUBACK matching
+// wantPktID. A mismatched or missing PUBACK means the broker never
+// confirmed the publish, so the caller must treat it as failed (and let the
+// spool retry it) rather than assuming QoS 0-style fire-and-forget success.
+func mqttReadPuback(conn net.Conn, timeout time.Duration, wantPktID uint16) error {
+	body, err := mqttReadPacket(conn, timeout, 0x40, "PUBACK")
+	if err != nil {
+		return err
+	}
+	if len(body) < 2 {
+		return fmt.Errorf("PUBACK body too short: %d bytes", len(body))
+	}
+	gotPktID := uint16(body[0])<<8 | uint16(body[1])
+	if gotPktID != wantPktID {
+		return fmt.Errorf("PUBACK packet id %d does not match published packet id %d", gotPktID, wantPktID)
+	}
+	return nil
+}
+
+// natsRawSink speaks the NATS text protocol directly:
+// CONNECT {"verbose":false}\r\n once, then PUB <subject> <#bytes>\r\n<payload>\r\n
+// per message. publish reports success as soon as both writes to the
+// connection succeed; it does not wait for any acknowledgement from the
+// server, so only publishes whose write fails are spooled.
+type natsRawSink struct {
+	addr    string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *natsRawSink) ensureConnected() error {
+	if s.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte("CONNECT {\"verbose\":false}\r\n")); err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *natsRawSink) publish(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ensureConnected(); err != nil {
+		return err
+	}
+	frame := fmt.Sprintf("PUB %s %d\r\n", s.subject, len(payload))
+	if _, err := s.conn.Write([]byte(frame)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	if _, err := s.conn.Write(append(payload, '\r', '\n')); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *natsRawSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Sink wraps a rawSink with an at-least-once disk spool: a publish that
+// fails is appended to spoolPath instead of being dropped, and a caller-
+// driven RetrySpool keeps retrying the spool until the broker accepts it.
+// It's exported so callers that want per-call (rather than batched)
+// publishing, like the health-check daemon, can drive it directly instead
+// of going through OutputSink.
+type Sink struct {
+	inner     rawSink
+	spoolPath string
+	mu        sync.Mutex
+}
+
+func newSink(inner rawSink, spoolDir, name string) *Sink {
+	os.MkdirAll(spoolDir, 0755)
+	return &Sink{inner: inner, spoolPath: filepath.Join(spoolDir, name+".spool")}
+}
+
+// NewSinks builds one spooled raw sink per comma-separated URL in rawURLs.
+// Unlike OutputSink, it does no batching or background flushing: each
+// Publish call is sent immediately, and RetrySpool must be driven by the
+// caller (e.g. on a ticker) to replay failed publishes.
+func NewSinks(rawURLs, spoolDir string) ([]*Sink, error) {
+	var sinks []*Sink
+	for _, rawURL := range strings.Split(rawURLs, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		if rawURL == "" {
+			continue
+		}
+		raw, _, err := newRawSink(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		// Index the spool filename by position, not just by topic: two
+		// sinks (e.g. a primary/failover pair) can share a topic, and a
+		// shared spool file would let one sink's retry replay the other
+		// sink's queued payloads.
+		name := fmt.Sprintf("%d-%s", len(sinks), sanitizeSpoolName(rawURL))
+		sinks = append(sinks, newSink(raw, spoolDir, name))
+	}
+	return sinks, nil
+}
+
+// Publish sends payload to the broker, spooling it to disk on failure.
+func (s *Sink) Publish(payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.inner.publish(payload); err != nil {
+		log.Printf("sink publish failed, spooling to %s: %v", s.spoolPath, err)
+		s.appendToSpool(payload)
+	}
+}
+
+func (s *Sink) appendToSpool(payload []byte) {
+	f, err := os.OpenFile(s.spoolPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("could not open spool file %s: %v", s.spoolPath, err)
+		return
+	}
+	defer f.Close()
+	encoded := base64.StdEncoding.EncodeToString(payload)
+	f.WriteString(encoded + "\n")
+}
+
+// RetrySpool replays spoolPath against inner, keeping any line that still
+// fails so it's retried next time instead of being lost.
+func (s *Sink) RetrySpool() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.spoolPath)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+	var remaining []string
+	for _, line := range lines {
+		payload, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			continue // drop corrupt spool lines rather than retrying forever
+		}
+		if err := s.inner.publish(payload); err != nil {
+			remaining = append(remaining, line)
+		}
+	}
+
+	if len(remaining) == len(lines) {
+		return // nothing delivered; leave the spool file as-is
+	}
+	if len(remaining) == 0 {
+		os.Remove(s.spoolPath)
+		return
+	}
+	os.WriteFile(s.spoolPath, []byte(strings.Join(remaining, "\n")+"\n"), 0644)
+}
+
+// OutputSink is what the rest of the program publishes to. It batches
+// small messages from multiple Publish calls into a single send per sink,
+// and fans out to every configured broker.
+type OutputSink struct {
+	mu            sync.Mutex
+	buf           [][]byte
+	batchSize     int
+	flushInterval time.Duration
+	sinks         []*Sink
+}
+
+// NewOutputSink builds one spooled raw sink per comma-separated URL in
+// rawURLs and starts the batch-flush and spool-retry background loops.
+func NewOutputSink(rawURLs string, batchSize int, flushInterval time.Duration, spoolDir string) (*OutputSink, error) {
+	sinks, err := NewSinks(rawURLs, spoolDir)
+	if err != nil {
+		return nil, err
+	}
+	s := &OutputSink{batchSize: batchSize, flushInterval: flushInterval, sinks: sinks}
+
+	go s.flushLoop()
+	go s.retryLoop()
+	return s, nil
+}
+
+// Publish enqueues payload for the next batch flush.
+func (s *OutputSink) Publish(payload []byte) {
+	s.mu.Lock()
+	s.buf = append(s.buf, payload)
+	full := len(s.buf) >= s.batchSize
+	s.mu.Unlock()
+	if full {
+		s.flush()
+	}
+}
+
+func (s *OutputSink) flushLoop() {
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.flush()
+	}
+}
+
+// flush combines the buffered payloads into one newline-delimited batch and
+// sends it to every sink. A Sink.Publish to an mqtt:// sink blocks for its
+// broker's ack (QoS 1 PUBACK), so the send happens with mu released: holding
+// mu here would stall every other Publish/flush call on this OutputSink -
+// across unrelated requests - for as long as one sink's broker takes to ack.
+func (s *OutputSink) flush() {
+	s.mu.Lock()
+	if len(s.buf) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	var batch []byte
+	for _, payload := range s.buf {
+		batch = append(batch, payload...)
+		batch = append(batch, '\n')
+	}
+	s.buf = nil
+	s.mu.Unlock()
+
+	for _, sink := range s.sinks {
+		sink.Publish(batch)
+	}
+}
+
+func (s *OutputSink) retryLoop() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, sink := range s.sinks {
+			sink.RetrySpool()
+		}
+	}
+}
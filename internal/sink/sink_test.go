@@ -0,0 +1,158 @@
+package sink
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSanitizeSpoolName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"mqtt://broker:1883/topic/detections", "mqtt___broker_1883_topic_detections"},
+		{"", "sink"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeSpoolName(tt.in); got != tt.want {
+			t.Errorf("sanitizeSpoolName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewRawSinkRejectsUnvendoredSchemes(t *testing.T) {
+	tests := []string{"kafka://broker:9092/detections", "amqp://broker:5672/detections", "bogus://broker/topic"}
+	for _, url := range tests {
+		if _, _, err := newRawSink(url); err == nil {
+			t.Errorf("newRawSink(%q): expected an error at configuration time, got nil", url)
+		}
+	}
+}
+
+func TestMqttRemainingLengthRoundTrip(t *testing.T) {
+	tests := []int{0, 1, 127, 128, 16383, 16384, 2097151}
+	for _, n := range tests {
+		encoded := mqttRemainingLength(n)
+
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		go client.Write(encoded)
+
+		got, err := mqttReadRemainingLength(server)
+		if err != nil {
+			t.Fatalf("mqttReadRemainingLength(%d): %v", n, err)
+		}
+		if got != n {
+			t.Errorf("mqttReadRemainingLength(mqttRemainingLength(%d)) = %d, want %d", n, got, n)
+		}
+	}
+}
+
+func TestMqttConnectConnackRoundTrip(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		mqttWriteConnect(client)
+	}()
+
+	// Read back what mqttWriteConnect sent and reply with a successful
+	// CONNACK, exactly as a real broker would.
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("reading CONNECT header: %v", err)
+	}
+	if header[0] != 0x10 {
+		t.Fatalf("CONNECT header = 0x%X, want 0x10", header[0])
+	}
+	remaining, err := mqttReadRemainingLength(server)
+	if err != nil {
+		t.Fatalf("reading CONNECT remaining length: %v", err)
+	}
+	body := make([]byte, remaining)
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("reading CONNECT body: %v", err)
+	}
+
+	go server.Write([]byte{0x20, 0x02, 0x00, 0x00})
+
+	if err := mqttReadConnack(client, time.Second); err != nil {
+		t.Errorf("mqttReadConnack: %v", err)
+	}
+}
+
+func TestMqttReadConnackRejectsFailureCode(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go server.Write([]byte{0x20, 0x02, 0x00, 0x05}) // return code 5: not authorized
+
+	if err := mqttReadConnack(client, time.Second); err == nil {
+		t.Error("expected mqttReadConnack to reject a non-zero return code")
+	}
+}
+
+func TestMqttPublishPubackRoundTrip(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	const pktID = uint16(42)
+	topic := "detections"
+	payload := []byte(`{"hello":"world"}`)
+
+	go mqttWritePublish(client, topic, payload, pktID)
+
+	header := make([]byte, 1)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("reading PUBLISH header: %v", err)
+	}
+	if header[0] != 0x32 {
+		t.Fatalf("PUBLISH header = 0x%X, want 0x32 (QoS 1)", header[0])
+	}
+	remaining, err := mqttReadRemainingLength(server)
+	if err != nil {
+		t.Fatalf("reading PUBLISH remaining length: %v", err)
+	}
+	body := make([]byte, remaining)
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatalf("reading PUBLISH body: %v", err)
+	}
+	topicLen := int(body[0])<<8 | int(body[1])
+	gotTopic := string(body[2 : 2+topicLen])
+	gotPktID := uint16(body[2+topicLen])<<8 | uint16(body[3+topicLen])
+	gotPayload := body[4+topicLen:]
+	if gotTopic != topic {
+		t.Errorf("PUBLISH topic = %q, want %q", gotTopic, topic)
+	}
+	if gotPktID != pktID {
+		t.Errorf("PUBLISH packet id = %d, want %d", gotPktID, pktID)
+	}
+	if string(gotPayload) != string(payload) {
+		t.Errorf("PUBLISH payload = %q, want %q", gotPayload, payload)
+	}
+
+	go server.Write([]byte{0x40, 0x02, byte(pktID >> 8), byte(pktID)})
+
+	if err := mqttReadPuback(client, time.Second, pktID); err != nil {
+		t.Errorf("mqttReadPuback: %v", err)
+	}
+}
+
+func TestMqttReadPubackRejectsMismatchedPacketID(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go server.Write([]byte{0x40, 0x02, 0x00, 0x02}) // PUBACK for packet id 2
+
+	if err := mqttReadPuback(client, time.Second, 1); err == nil {
+		t.Error("expected mqttReadPuback to reject a PUBACK for the wrong packet id")
+	}
+}
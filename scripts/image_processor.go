@@ -1,3 +1,9 @@
+// Command image_processor is the Camel Router-facing entry point for the
+// processor package: it wires up flags and CONFIG_* environment variables,
+// then either processes a single input file or runs the persistent HTTP
+// worker (-serve). All of the actual detection-scoring, tracking and
+// serving logic lives in taskinity/dsl/internal/processor so it can be
+// reused without duplicating this file.
 package main
 
 import (
@@ -9,48 +15,10 @@ import (
 	"os"
 	"strconv"
 	"time"
-)
-
-type InputData struct {
-	Timestamp  string      `json:"timestamp"`
-	Source     string      `json:"source"`
-	Data       interface{} `json:"data"`
-	Detections []Detection `json:"detections,omitempty"`
-}
-
-type Detection struct {
-	ObjectType string    `json:"object_type"`
-	Confidence float64   `json:"confidence"`
-	BBox       []float64 `json:"bbox"`
-	Position   string    `json:"position"`
-}
-
-type OutputData struct {
-	Timestamp        string      `json:"timestamp"`
-	Source           string      `json:"source"`
-	ProcessedBy      string      `json:"processed_by"`
-	EnhancedDetections []EnhancedDetection `json:"enhanced_detections"`
-	ThreatLevel      string      `json:"threat_level"`
-	ProcessingTime   float64     `json:"processing_time_ms"`
-}
 
-type EnhancedDetection struct {
-	Detection
-	RiskScore   float64 `json:"risk_score"`
-	Zone        string  `json:"zone"`
-	Action      string  `json:"recommended_action"`
-}
-
-func loadConfig() map[string]string {
-	config := make(map[string]string)
-	
-	// Load configuration from environment variables set by Camel Router
-	config["zone_mapping"] = getEnv("CONFIG_ZONE_MAPPING", "entrance:high,parking:medium,garden:low")
-	config["threat_threshold"] = getEnv("CONFIG_THREAT_THRESHOLD", "0.7")
-	config["processor_name"] = getEnv("CONFIG_PROCESSOR_NAME", "golang-image-processor")
-	
-	return config
-}
+	"taskinity/dsl/internal/processor"
+	"taskinity/dsl/internal/sink"
+)
 
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -59,128 +27,130 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func calculateRiskScore(detection Detection, config map[string]string) float64 {
-	baseRisk := detection.Confidence
-	
-	// Increase risk for certain object types
-	switch detection.ObjectType {
-	case "person":
-		baseRisk *= 1.2
-	case "car":
-		baseRisk *= 0.8
-	case "cat", "dog":
-		baseRisk *= 0.3
-	}
-	
-	// Increase risk for certain positions
-	if detection.Position == "center-center" {
-		baseRisk *= 1.1
-	}
-	
-	return baseRisk
-}
+func main() {
+	var inputFile = flag.String("input", "", "Input JSON file")
+	var outputFile = flag.String("output", "", "Output JSON file (optional)")
+	var serve = flag.Bool("serve", false, "Run as a persistent HTTP worker instead of processing a single file")
+	var rulesFile = flag.String("rules", "", "Rule engine config file (defaults to CONFIG_RULES_FILE)")
+	var validateRules = flag.Bool("validate-rules", false, "Load and validate the rule engine config, then exit")
+	flag.Parse()
 
-func determineZone(detection Detection) string {
-	// Simple zone determination based on position
-	// In real implementation, this would use actual coordinates
-	switch detection.Position {
-	case "center-center":
-		return "entrance"
-	case "bottom-left", "bottom-right":
-		return "parking"
-	default:
-		return "perimeter"
+	// Load configuration
+	config := processor.LoadConfig()
+
+	rulesPath := *rulesFile
+	if rulesPath == "" {
+		rulesPath = os.Getenv("CONFIG_RULES_FILE")
 	}
-}
 
-func recommendAction(riskScore float64, objectType string) string {
-	if riskScore > 0.8 {
-		if objectType == "person" {
-			return "alert_security"
+	if *validateRules {
+		if rulesPath == "" {
+			log.Fatal("No rules file given: pass -rules or set CONFIG_RULES_FILE")
 		}
-		return "monitor_closely"
-	} else if riskScore > 0.5 {
-		return "log_event"
+		if _, err := processor.LoadRuleSet(rulesPath); err != nil {
+			log.Fatalf("Invalid rules file %s: %v", rulesPath, err)
+		}
+		fmt.Printf("%s: ok\n", rulesPath)
+		return
 	}
-	return "ignore"
-}
 
-func processDetections(input InputData, config map[string]string) OutputData {
-	startTime := time.Now()
-	
-	var enhanced []EnhancedDetection
-	maxRisk := 0.0
-	
-	for _, detection := range input.Detections {
-		riskScore := calculateRiskScore(detection, config)
-		zone := determineZone(detection)
-		action := recommendAction(riskScore, detection.ObjectType)
-		
-		enhanced = append(enhanced, EnhancedDetection{
-			Detection:   detection,
-			RiskScore:   riskScore,
-			Zone:        zone,
-			Action:      action,
-		})
-		
-		if riskScore > maxRisk {
-			maxRisk = riskScore
+	if rulesPath != "" {
+		rs, err := processor.LoadRuleSet(rulesPath)
+		if err != nil {
+			log.Fatalf("Error loading rules file: %v", err)
 		}
+		processor.SetRuleSet(rs)
+	} else {
+		processor.SetRuleSet(processor.DefaultRuleSet())
 	}
-	
-	// Determine overall threat level
-	threatLevel := "low"
-	if maxRisk > 0.8 {
-		threatLevel = "high"
-	} else if maxRisk > 0.5 {
-		threatLevel = "medium"
+	processor.WatchRuleSetReloads(rulesPath)
+
+	maxTracks, err := strconv.Atoi(getEnv("CONFIG_TRACKER_MAX_TRACKS", "1000"))
+	if err != nil || maxTracks <= 0 {
+		maxTracks = 1000
 	}
-	
-	processingTime := float64(time.Since(startTime).Nanoseconds()) / 1e6 // Convert to milliseconds
-	
-	return OutputData{
-		Timestamp:          time.Now().Format(time.RFC3339),
-		Source:             input.Source,
-		ProcessedBy:        config["processor_name"],
-		EnhancedDetections: enhanced,
-		ThreatLevel:        threatLevel,
-		ProcessingTime:     processingTime,
+	maxAgeSeconds, err := strconv.Atoi(getEnv("CONFIG_TRACKER_MAX_AGE_SECONDS", "300"))
+	if err != nil || maxAgeSeconds <= 0 {
+		maxAgeSeconds = 300
+	}
+	iouThreshold, err := strconv.ParseFloat(getEnv("CONFIG_TRACKER_IOU_THRESHOLD", "0.3"), 64)
+	if err != nil || iouThreshold <= 0 {
+		iouThreshold = 0.3
+	}
+	processor.SetTracker(processor.NewTracker(maxTracks, time.Duration(maxAgeSeconds)*time.Second, iouThreshold))
+
+	if sinkURLs := os.Getenv("CONFIG_SINK_URL"); sinkURLs != "" {
+		batchSize, err := strconv.Atoi(getEnv("CONFIG_SINK_BATCH_SIZE", "20"))
+		if err != nil || batchSize <= 0 {
+			batchSize = 20
+		}
+		flushMs, err := strconv.Atoi(getEnv("CONFIG_SINK_FLUSH_MS", "1000"))
+		if err != nil || flushMs <= 0 {
+			flushMs = 1000
+		}
+		spoolDir := getEnv("CONFIG_SINK_SPOOL_DIR", "./spool")
+
+		outputSink, err := sink.NewOutputSink(sinkURLs, batchSize, time.Duration(flushMs)*time.Millisecond, spoolDir)
+		if err != nil {
+			log.Fatalf("Error configuring CONFIG_SINK_URL: %v", err)
+		}
+		processor.SetOutputSink(outputSink)
+	}
+
+	if *serve {
+		addr := getEnv("CONFIG_SERVE_ADDR", ":8082")
+		poolSize, err := strconv.Atoi(getEnv("CONFIG_WORKER_POOL_SIZE", "4"))
+		if err != nil || poolSize <= 0 {
+			poolSize = 4
+		}
+		queueSize, err := strconv.Atoi(getEnv("CONFIG_QUEUE_SIZE", "100"))
+		if err != nil || queueSize <= 0 {
+			queueSize = 100
+		}
+		requestTimeoutMs, err := strconv.Atoi(getEnv("CONFIG_REQUEST_TIMEOUT_MS", "5000"))
+		if err != nil || requestTimeoutMs <= 0 {
+			requestTimeoutMs = 5000
+		}
+		streamMaxLineBytes, err := strconv.Atoi(getEnv("CONFIG_STREAM_MAX_LINE_BYTES", "4194304"))
+		if err != nil || streamMaxLineBytes <= 0 {
+			streamMaxLineBytes = 4194304
+		}
+
+		pool := processor.NewWorkerPool(poolSize, queueSize)
+		metrics := processor.NewServerMetrics()
+		if err := processor.ServeHTTP(addr, pool, config, metrics, time.Duration(requestTimeoutMs)*time.Millisecond, streamMaxLineBytes); err != nil {
+			log.Fatalf("Server error: %v", err)
+		}
+		return
 	}
-}
 
-func main() {
-	var inputFile = flag.String("input", "", "Input JSON file")
-	var outputFile = flag.String("output", "", "Output JSON file (optional)")
-	flag.Parse()
-	
 	if *inputFile == "" {
 		log.Fatal("Input file is required")
 	}
-	
-	// Load configuration
-	config := loadConfig()
-	
+
 	// Read input file
 	inputData, err := ioutil.ReadFile(*inputFile)
 	if err != nil {
 		log.Fatalf("Error reading input file: %v", err)
 	}
-	
+
 	// Parse input JSON
-	var input InputData
+	var input processor.InputData
 	if err := json.Unmarshal(inputData, &input); err != nil {
 		log.Fatalf("Error parsing input JSON: %v", err)
 	}
-	
+
 	// Process the data
-	output := processDetections(input, config)
-	
+	output := processor.ProcessDetections(input, config)
+
 	// Convert output to JSON
 	outputJSON, err := json.MarshalIndent(output, "", "  ")
 	if err != nil {
 		log.Fatalf("Error marshaling output: %v", err)
 	}
-	
+
+	processor.PublishOutput(output)
+
 	// Write output
 	if *outputFile != "" {
 		if err := ioutil.WriteFile(*outputFile, outputJSON, 0644); err != nil {
@@ -189,4 +159,4 @@ func main() {
 	} else {
 		fmt.Println(string(outputJSON))
 	}
-}
\ No newline at end of file
+}
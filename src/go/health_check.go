@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"taskinity/dsl/internal/sink"
 )
 
 type HealthInput struct {
@@ -16,50 +24,233 @@ type HealthInput struct {
 	Trigger   string `json:"trigger"`
 }
 
+// ServiceCheck describes a single configured check, as read from the
+// structured CONFIG_CHECK_ENDPOINTS config (JSON array or @file).
+type ServiceCheck struct {
+	Name              string            `json:"name"`
+	Group             string            `json:"group"`
+	Type              string            `json:"type"` // "http" (default), "tcp", "dns"
+	URL               string            `json:"url"`
+	Method            string            `json:"method"`
+	Body              string            `json:"body"`
+	Headers           map[string]string `json:"headers"`
+	ExpectedStatus    int               `json:"expected_status"`
+	ExpectedBodyRegex string            `json:"expected_body_regex"`
+	IntervalSeconds   int               `json:"interval_seconds"`
+	FailureThreshold  int               `json:"failure_threshold"`
+
+	bodyRegex *regexp.Regexp
+}
+
 type ServiceHealth struct {
-	Service    string  `json:"service"`
-	URL        string  `json:"url"`
-	Status     string  `json:"status"`
+	Service      string  `json:"service"`
+	Group        string  `json:"group"`
+	URL          string  `json:"url"`
+	Status       string  `json:"status"`
 	ResponseTime float64 `json:"response_time_ms"`
-	Error      string  `json:"error,omitempty"`
+	Error        string  `json:"error,omitempty"`
 }
 
-type HealthOutput struct {
-	Timestamp    string          `json:"timestamp"`
-	OverallStatus string         `json:"status"`
+// GroupHealth aggregates the services that share a ServiceCheck.Group.
+type GroupHealth struct {
+	Group        string          `json:"group"`
+	Status       string          `json:"status"`
 	Services     []ServiceHealth `json:"services"`
-	HealthyCount int            `json:"healthy_count"`
-	TotalCount   int            `json:"total_count"`
+	HealthyCount int             `json:"healthy_count"`
+	TotalCount   int             `json:"total_count"`
+}
+
+type HealthOutput struct {
+	Timestamp     string          `json:"timestamp"`
+	OverallStatus string          `json:"status"`
+	Groups        []GroupHealth   `json:"groups"`
+	Services      []ServiceHealth `json:"services"`
+	HealthyCount  int             `json:"healthy_count"`
+	TotalCount    int             `json:"total_count"`
+}
+
+const defaultGroup = "default"
+
+// parseChecks turns CONFIG_CHECK_ENDPOINTS into a list of ServiceChecks. It
+// accepts three forms, tried in order: a path to a JSON file when prefixed
+// with "@", an inline JSON array, or (for backward compatibility) a plain
+// comma-separated list of URLs, which all land in defaultGroup.
+//
+// "@" paths ending in .yaml/.yml are rejected with a clear error rather than parsed,
+// since this tree doesn't vendor gopkg.in/yaml.v3; use the equivalent JSON
+// array instead.
+func parseChecks(raw string) ([]ServiceCheck, error) {
+	var data []byte
+	var err error
+
+	switch {
+	case strings.HasPrefix(raw, "@"):
+		path := strings.TrimPrefix(raw, "@")
+		if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+			return nil, fmt.Errorf("YAML check config %q requires gopkg.in/yaml.v3, which is not vendored in this build; use an equivalent JSON array instead", path)
+		}
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading check config: %w", err)
+		}
+	case strings.HasPrefix(strings.TrimSpace(raw), "["):
+		data = []byte(raw)
+	default:
+		return parseLegacyEndpoints(raw), nil
+	}
+
+	var checks []ServiceCheck
+	if err := json.Unmarshal(data, &checks); err != nil {
+		return nil, fmt.Errorf("parsing check config: %w", err)
+	}
+	for i := range checks {
+		if checks[i].Group == "" {
+			checks[i].Group = defaultGroup
+		}
+		if checks[i].Type == "" {
+			checks[i].Type = "http"
+		}
+		if checks[i].Method == "" {
+			checks[i].Method = http.MethodGet
+		}
+		if checks[i].Name == "" {
+			checks[i].Name = extractServiceName(checks[i].URL)
+		}
+		if checks[i].ExpectedBodyRegex != "" {
+			re, err := regexp.Compile(checks[i].ExpectedBodyRegex)
+			if err != nil {
+				return nil, fmt.Errorf("compiling expected_body_regex for %s: %w", checks[i].Name, err)
+			}
+			checks[i].bodyRegex = re
+		}
+	}
+	return checks, nil
+}
+
+func parseLegacyEndpoints(raw string) []ServiceCheck {
+	var checks []ServiceCheck
+	for _, url := range strings.Split(raw, ",") {
+		url = strings.TrimSpace(url)
+		if url == "" {
+			continue
+		}
+		checks = append(checks, ServiceCheck{
+			Name:   extractServiceName(url),
+			Group:  defaultGroup,
+			Type:   "http",
+			URL:    url,
+			Method: http.MethodGet,
+		})
+	}
+	return checks
 }
 
-func checkService(url string, timeout time.Duration) ServiceHealth {
+func runCheck(check ServiceCheck, timeout time.Duration) ServiceHealth {
+	switch check.Type {
+	case "tcp":
+		return runTCPCheck(check, timeout)
+	case "dns":
+		return runDNSCheck(check, timeout)
+	default:
+		return runHTTPCheck(check, timeout)
+	}
+}
+
+func runHTTPCheck(check ServiceCheck, timeout time.Duration) ServiceHealth {
 	start := time.Now()
-	
+
+	var bodyReader *strings.Reader
+	if check.Body != "" {
+		bodyReader = strings.NewReader(check.Body)
+	} else {
+		bodyReader = strings.NewReader("")
+	}
+
+	method := check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	service := ServiceHealth{Service: check.Name, Group: check.Group, URL: check.URL}
+
+	req, err := http.NewRequest(method, check.URL, bodyReader)
+	if err != nil {
+		service.Status = "unhealthy"
+		service.Error = err.Error()
+		return service
+	}
+	for key, value := range check.Headers {
+		req.Header.Set(key, value)
+	}
+
 	client := &http.Client{Timeout: timeout}
-	resp, err := client.Get(url)
-	
-	responseTime := float64(time.Since(start).Nanoseconds()) / 1e6
-	
-	service := ServiceHealth{
-		Service:      extractServiceName(url),
-		URL:          url,
-		ResponseTime: responseTime,
-	}
-	
+	resp, err := client.Do(req)
+	service.ResponseTime = float64(time.Since(start).Nanoseconds()) / 1e6
+
 	if err != nil {
 		service.Status = "unhealthy"
 		service.Error = err.Error()
 		return service
 	}
 	defer resp.Body.Close()
-	
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		service.Status = "healthy"
-	} else {
+
+	expectedStatus := check.ExpectedStatus
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if expectedStatus != 0 {
+		statusOK = resp.StatusCode == expectedStatus
+	}
+
+	if !statusOK {
 		service.Status = "unhealthy"
 		service.Error = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		return service
+	}
+
+	if check.bodyRegex != nil {
+		body, _ := io.ReadAll(resp.Body)
+		if !check.bodyRegex.Match(body) {
+			service.Status = "unhealthy"
+			service.Error = "response body did not match expected_body_regex"
+			return service
+		}
+	}
+
+	service.Status = "healthy"
+	return service
+}
+
+func runTCPCheck(check ServiceCheck, timeout time.Duration) ServiceHealth {
+	start := time.Now()
+	service := ServiceHealth{Service: check.Name, Group: check.Group, URL: check.URL}
+
+	conn, err := net.DialTimeout("tcp", check.URL, timeout)
+	service.ResponseTime = float64(time.Since(start).Nanoseconds()) / 1e6
+	if err != nil {
+		service.Status = "unhealthy"
+		service.Error = err.Error()
+		return service
+	}
+	conn.Close()
+	service.Status = "healthy"
+	return service
+}
+
+func runDNSCheck(check ServiceCheck, timeout time.Duration) ServiceHealth {
+	start := time.Now()
+	service := ServiceHealth{Service: check.Name, Group: check.Group, URL: check.URL}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resolver := &net.Resolver{}
+	_, err := resolver.LookupHost(ctx, check.URL)
+	service.ResponseTime = float64(time.Since(start).Nanoseconds()) / 1e6
+	if err != nil {
+		service.Status = "unhealthy"
+		service.Error = err.Error()
+		return service
 	}
-	
+	service.Status = "healthy"
 	return service
 }
 
@@ -71,71 +262,340 @@ func extractServiceName(url string) string {
 	return url
 }
 
+// runChecks executes every configured check and assembles the nested
+// group/service HealthOutput. It's used for the one-shot (non -daemon) code
+// path, where there's only a single run of each check and FailureThreshold
+// hysteresis doesn't apply.
+func runChecks(checks []ServiceCheck, timeout time.Duration) HealthOutput {
+	results := make([]ServiceHealth, len(checks))
+	for i, check := range checks {
+		results[i] = runCheck(check, timeout)
+	}
+	return buildHealthOutput(checks, results)
+}
+
+// buildHealthOutput assembles the nested group/service HealthOutput from
+// one ServiceHealth per check, in check order.
+func buildHealthOutput(checks []ServiceCheck, results []ServiceHealth) HealthOutput {
+	groupOrder := []string{}
+	groups := map[string]*GroupHealth{}
+	var services []ServiceHealth
+	healthyCount := 0
+
+	for i := range checks {
+		health := results[i]
+		services = append(services, health)
+		if health.Status == "healthy" {
+			healthyCount++
+		}
+
+		group, ok := groups[health.Group]
+		if !ok {
+			group = &GroupHealth{Group: health.Group}
+			groups[health.Group] = group
+			groupOrder = append(groupOrder, health.Group)
+		}
+		group.Services = append(group.Services, health)
+		group.TotalCount++
+		if health.Status == "healthy" {
+			group.HealthyCount++
+		}
+	}
+
+	var groupList []GroupHealth
+	for _, name := range groupOrder {
+		g := groups[name]
+		g.Status = aggregateStatus(g.HealthyCount, g.TotalCount)
+		groupList = append(groupList, *g)
+	}
+
+	return HealthOutput{
+		Timestamp:     time.Now().Format(time.RFC3339),
+		OverallStatus: aggregateStatus(healthyCount, len(services)),
+		Groups:        groupList,
+		Services:      services,
+		HealthyCount:  healthyCount,
+		TotalCount:    len(services),
+	}
+}
+
+func aggregateStatus(healthy, total int) string {
+	if total == 0 || healthy == 0 {
+		if total == 0 {
+			return "healthy"
+		}
+		return "critical"
+	}
+	if healthy < total {
+		return "degraded"
+	}
+	return "healthy"
+}
+
+// latestResults is shared between the daemon's check loop and its HTTP
+// server, guarded by resultsMu.
+var (
+	resultsMu     sync.RWMutex
+	latestResults HealthOutput
+)
+
+func setLatestResults(output HealthOutput) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+	latestResults = output
+}
+
+func getLatestResults() HealthOutput {
+	resultsMu.RLock()
+	defer resultsMu.RUnlock()
+	return latestResults
+}
+
+// checkTracker runs one ServiceCheck on its own schedule and applies
+// FailureThreshold hysteresis: a failing check keeps reporting its last
+// healthy result until it has failed FailureThreshold times in a row, so a
+// single transient failure doesn't flip the service (and its group/overall
+// status) to unhealthy. Before its first success, a check reports a healthy
+// placeholder with no response time in that window.
+type checkTracker struct {
+	check ServiceCheck
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	reported            ServiceHealth
+}
+
+func newCheckTracker(check ServiceCheck) *checkTracker {
+	return &checkTracker{
+		check:    check,
+		reported: ServiceHealth{Service: check.Name, Group: check.Group, URL: check.URL, Status: "healthy"},
+	}
+}
+
+// run executes the check and returns the (possibly hysteresis-delayed)
+// reported ServiceHealth.
+func (ct *checkTracker) run(timeout time.Duration) ServiceHealth {
+	result := runCheck(ct.check, timeout)
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if result.Status == "healthy" {
+		ct.consecutiveFailures = 0
+		ct.reported = result
+		return ct.reported
+	}
+
+	ct.consecutiveFailures++
+	threshold := ct.check.FailureThreshold
+	if threshold <= 0 {
+		threshold = 1
+	}
+	if ct.consecutiveFailures >= threshold {
+		ct.reported = result
+	}
+	return ct.reported
+}
+
+func serveDaemon(checks []ServiceCheck, timeout, interval time.Duration, addr string) error {
+	trackers := make([]*checkTracker, len(checks))
+	results := make([]ServiceHealth, len(checks))
+	var resultsLock sync.Mutex
+
+	for i, check := range checks {
+		trackers[i] = newCheckTracker(check)
+		results[i] = trackers[i].run(timeout)
+	}
+
+	publish := func() {
+		resultsLock.Lock()
+		output := buildHealthOutput(checks, results)
+		resultsLock.Unlock()
+		setLatestResults(output)
+		publishHealth(output)
+	}
+	publish()
+
+	// Each check runs on its own ticker - check.IntervalSeconds when set,
+	// otherwise the daemon's CONFIG_CHECK_INTERVAL - rather than all checks
+	// sharing a single global ticker.
+	for i, check := range checks {
+		i := i
+		checkInterval := interval
+		if check.IntervalSeconds > 0 {
+			checkInterval = time.Duration(check.IntervalSeconds) * time.Second
+		}
+		go func() {
+			ticker := time.NewTicker(checkInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				health := trackers[i].run(timeout)
+				resultsLock.Lock()
+				results[i] = health
+				resultsLock.Unlock()
+				publish()
+			}
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/health", func(w http.ResponseWriter, r *http.Request) {
+		output := getLatestResults()
+		w.Header().Set("Content-Type", "application/json")
+		if output.OverallStatus != "healthy" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(output)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheusMetrics(w, getLatestResults())
+	})
+
+	log.Printf("health-check daemon listening on %s (interval=%s, %d checks)", addr, interval, len(checks))
+	return http.ListenAndServe(addr, mux)
+}
+
+func writePrometheusMetrics(w http.ResponseWriter, output HealthOutput) {
+	fmt.Fprintln(w, "# HELP health_check_up Whether the last check for a service succeeded (1) or not (0).")
+	fmt.Fprintln(w, "# TYPE health_check_up gauge")
+	for _, svc := range output.Services {
+		up := 0
+		if svc.Status == "healthy" {
+			up = 1
+		}
+		fmt.Fprintf(w, "health_check_up{service=%q,group=%q} %d\n", svc.Service, svc.Group, up)
+	}
+
+	fmt.Fprintln(w, "# HELP health_check_response_time_ms Response time of the last check, in a fixed-bucket histogram.")
+	fmt.Fprintln(w, "# TYPE health_check_response_time_ms histogram")
+	buckets := []float64{10, 50, 100, 250, 500, 1000, 2500, 5000}
+	for _, svc := range output.Services {
+		cumulative := uint64(0)
+		for _, bound := range buckets {
+			if svc.ResponseTime <= bound {
+				cumulative = 1
+			}
+			fmt.Fprintf(w, "health_check_response_time_ms_bucket{service=%q,group=%q,le=\"%g\"} %d\n", svc.Service, svc.Group, bound, cumulative)
+		}
+		fmt.Fprintf(w, "health_check_response_time_ms_bucket{service=%q,group=%q,le=\"+Inf\"} 1\n", svc.Service, svc.Group)
+		fmt.Fprintf(w, "health_check_response_time_ms_sum{service=%q,group=%q} %g\n", svc.Service, svc.Group, svc.ResponseTime)
+		fmt.Fprintf(w, "health_check_response_time_ms_count{service=%q,group=%q} 1\n", svc.Service, svc.Group)
+	}
+}
+
+// --- output sinks ---
+//
+// CONFIG_SINK_URL lets HealthOutput be published to one or more message
+// brokers in addition to the file/stdout output, so a -daemon instance acts
+// as an event producer in a Camel Router pipeline rather than something that
+// has to be polled. It's a comma-separated list of URLs, e.g.
+// "mqtt://broker:1883/topic/health,nats://broker:4222/health". The actual
+// broker connections, spooling and retry live in taskinity/dsl/internal/sink,
+// shared with the image-processor tool; health-check publishes each
+// HealthOutput immediately rather than batching, since checks already run on
+// their own interval.
+
+// healthSinks holds every configured sink; nil/empty unless CONFIG_SINK_URL
+// is set.
+var healthSinks []*sink.Sink
+
+// publishHealth fans HealthOutput out to every configured sink.
+func publishHealth(output HealthOutput) {
+	if len(healthSinks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(output)
+	if err != nil {
+		log.Printf("Error marshaling health output for sink publish: %v", err)
+		return
+	}
+	for _, s := range healthSinks {
+		s.Publish(payload)
+	}
+}
+
+func watchSinkRetries() {
+	if len(healthSinks) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, s := range healthSinks {
+				s.RetrySpool()
+			}
+		}
+	}()
+}
+
 func main() {
 	var inputFile = flag.String("input", "", "Input JSON file")
 	var outputFile = flag.String("output", "", "Output JSON file (optional)")
+	var daemon = flag.Bool("daemon", false, "Run checks on a schedule and serve results over HTTP")
 	flag.Parse()
-	
-	if *inputFile == "" {
-		log.Fatal("Input file is required")
-	}
-	
+
 	// Load configuration from environment
 	endpoints := os.Getenv("CONFIG_CHECK_ENDPOINTS")
 	if endpoints == "" {
 		endpoints = "http://localhost:8080/health"
 	}
-	
+
 	timeoutStr := os.Getenv("CONFIG_TIMEOUT")
 	timeout, err := time.ParseDuration(timeoutStr + "s")
 	if err != nil {
 		timeout = 10 * time.Second
 	}
-	
-	// Parse endpoints
-	urls := strings.Split(endpoints, ",")
-	
-	// Check all services
-	var services []ServiceHealth
-	healthyCount := 0
-	
-	for _, url := range urls {
-		url = strings.TrimSpace(url)
-		if url == "" {
-			continue
+
+	checks, err := parseChecks(endpoints)
+	if err != nil {
+		log.Fatalf("Error parsing CONFIG_CHECK_ENDPOINTS: %v", err)
+	}
+
+	if sinkURLs := os.Getenv("CONFIG_SINK_URL"); sinkURLs != "" {
+		spoolDir := os.Getenv("CONFIG_SINK_SPOOL_DIR")
+		if spoolDir == "" {
+			spoolDir = "./spool"
 		}
-		
-		health := checkService(url, timeout)
-		services = append(services, health)
-		
-		if health.Status == "healthy" {
-			healthyCount++
+		sinks, err := sink.NewSinks(sinkURLs, spoolDir)
+		if err != nil {
+			log.Fatalf("Error configuring CONFIG_SINK_URL: %v", err)
 		}
+		healthSinks = sinks
+		watchSinkRetries()
 	}
-	
-	// Determine overall status
-	overallStatus := "healthy"
-	if healthyCount == 0 {
-		overallStatus = "critical"
-	} else if healthyCount < len(services) {
-		overallStatus = "degraded"
+
+	if *daemon {
+		interval := 30 * time.Second
+		if intervalStr := os.Getenv("CONFIG_CHECK_INTERVAL"); intervalStr != "" {
+			if secs, err := strconv.Atoi(intervalStr); err == nil && secs > 0 {
+				interval = time.Duration(secs) * time.Second
+			}
+		}
+		addr := os.Getenv("CONFIG_HEALTH_ADDR")
+		if addr == "" {
+			addr = ":8081"
+		}
+		if err := serveDaemon(checks, timeout, interval, addr); err != nil {
+			log.Fatalf("Daemon server error: %v", err)
+		}
+		return
 	}
-	
-	// Create output
-	output := HealthOutput{
-		Timestamp:     time.Now().Format(time.RFC3339),
-		OverallStatus: overallStatus,
-		Services:      services,
-		HealthyCount:  healthyCount,
-		TotalCount:    len(services),
+
+	if *inputFile == "" {
+		log.Fatal("Input file is required")
 	}
-	
+
+	output := runChecks(checks, timeout)
+	publishHealth(output)
+
 	// Convert to JSON
 	outputJSON, err := json.MarshalIndent(output, "", "  ")
 	if err != nil {
 		log.Fatalf("Error marshaling output: %v", err)
 	}
-	
+
 	// Write output
 	if *outputFile != "" {
 		if err := os.WriteFile(*outputFile, outputJSON, 0644); err != nil {
@@ -144,4 +604,4 @@ func main() {
 	} else {
 		fmt.Println(string(outputJSON))
 	}
-}
\ No newline at end of file
+}
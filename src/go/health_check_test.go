@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseChecksJSONArray(t *testing.T) {
+	raw := `[{"name":"api","group":"core","url":"http://api:8080/health"}]`
+	checks, err := parseChecks(raw)
+	if err != nil {
+		t.Fatalf("parseChecks: %v", err)
+	}
+	if len(checks) != 1 {
+		t.Fatalf("expected 1 check, got %d", len(checks))
+	}
+	c := checks[0]
+	if c.Name != "api" || c.Group != "core" || c.Type != "http" || c.Method != http.MethodGet {
+		t.Errorf("unexpected defaults applied: %+v", c)
+	}
+}
+
+func TestParseChecksDefaultsGroupAndName(t *testing.T) {
+	raw := `[{"url":"http://svc:8080/health"}]`
+	checks, err := parseChecks(raw)
+	if err != nil {
+		t.Fatalf("parseChecks: %v", err)
+	}
+	if checks[0].Group != defaultGroup {
+		t.Errorf("Group = %q, want default group %q", checks[0].Group, defaultGroup)
+	}
+	if checks[0].Name != "svc:8080" {
+		t.Errorf("Name = %q, want %q", checks[0].Name, "svc:8080")
+	}
+}
+
+func TestParseChecksLegacyCommaList(t *testing.T) {
+	checks, err := parseChecks("http://a:8080/health, http://b:8080/health")
+	if err != nil {
+		t.Fatalf("parseChecks: %v", err)
+	}
+	if len(checks) != 2 {
+		t.Fatalf("expected 2 checks, got %d", len(checks))
+	}
+	if checks[0].URL != "http://a:8080/health" || checks[1].URL != "http://b:8080/health" {
+		t.Errorf("unexpected URLs: %+v", checks)
+	}
+}
+
+func TestParseChecksAtFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checks.json")
+	if err := os.WriteFile(path, []byte(`[{"url":"http://a:8080/health"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	checks, err := parseChecks("@" + path)
+	if err != nil {
+		t.Fatalf("parseChecks: %v", err)
+	}
+	if len(checks) != 1 || checks[0].URL != "http://a:8080/health" {
+		t.Errorf("unexpected checks from @file: %+v", checks)
+	}
+}
+
+func TestParseChecksRejectsYAML(t *testing.T) {
+	if _, err := parseChecks("@/tmp/checks.yaml"); err == nil {
+		t.Error("expected parseChecks to reject a .yaml config path")
+	}
+	if _, err := parseChecks("@/tmp/checks.yml"); err == nil {
+		t.Error("expected parseChecks to reject a .yml config path")
+	}
+}
+
+func TestAggregateStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		healthy int
+		total   int
+		want    string
+	}{
+		{"no checks configured", 0, 0, "healthy"},
+		{"all failing", 0, 3, "critical"},
+		{"some failing", 2, 3, "degraded"},
+		{"all healthy", 3, 3, "healthy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aggregateStatus(tt.healthy, tt.total); got != tt.want {
+				t.Errorf("aggregateStatus(%d, %d) = %q, want %q", tt.healthy, tt.total, got, tt.want)
+			}
+		})
+	}
+}